@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	irc "github.com/fluffle/goirc/client"
+)
+
+// bridgeRelay carries one message a Bridge's upstream connection
+// received, destined for its local room, from the Bridge's own
+// goroutine into pool.Run, the same hand-off pattern Add/Delete/
+// Broadcast use to get connection-goroutine events onto the pool's
+// single dispatch loop.
+type bridgeRelay struct {
+	room string
+	nick string
+	text string
+}
+
+// bridgeMinBackoff and bridgeMaxBackoff bound the exponential backoff
+// Bridge.run uses between reconnect attempts.
+const (
+	bridgeMinBackoff = 2 * time.Second
+	bridgeMaxBackoff = 2 * time.Minute
+)
+
+// bridgeOutBufSize bounds a Bridge's outbound queue, mirroring
+// outBufSize for Clients: a wedged upstream network is a slow consumer
+// too, and must not be able to stall pool.Run by blocking on goirc's
+// own internal send channel.
+const bridgeOutBufSize = 128
+
+// Bridge relays messages between a channel on an upstream IRC network
+// and a local room in the ConnectionPool, the way nmdc-ircfrontend
+// proxies an alien protocol into an IRC-shaped surface - messages typed
+// in the local room are forwarded upstream as PRIVMSG, and messages
+// from the upstream channel appear locally prefixed "network/nick>".
+type Bridge struct {
+	pool    *ConnectionPool
+	network string
+	server  string
+	channel string // upstream channel, e.g. "#golang"
+	room    string // local room clients join to talk to this bridge
+
+	connMu sync.Mutex
+	conn   *irc.Conn // set while connected; nil between reconnect attempts
+
+	outBuf chan string // queued upstream PRIVMSG text, drained by relayLoop
+}
+
+// newBridge returns a Bridge that isn't connected yet; call run to start
+// it.
+func newBridge(pool *ConnectionPool, network, server, channel string) *Bridge {
+	return &Bridge{
+		pool:    pool,
+		network: network,
+		server:  server,
+		channel: channel,
+		room:    "#" + network,
+		outBuf:  make(chan string, bridgeOutBufSize),
+	}
+}
+
+// localNick is the nickname the bridge presents as on the upstream
+// network.
+func (b *Bridge) localNick() string {
+	return "bridge-" + b.network
+}
+
+// run connects to the upstream network and keeps relaying until
+// pool.quitc closes, reconnecting with exponential backoff whenever the
+// upstream connection drops.
+func (b *Bridge) run() {
+	go b.relayLoop()
+
+	backoff := bridgeMinBackoff
+	for {
+		disconnected := b.connect()
+		if disconnected != nil {
+			backoff = bridgeMinBackoff
+			select {
+			case <-disconnected:
+			case <-b.pool.quitc:
+				b.setConn(nil)
+				return
+			}
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-b.pool.quitc:
+			return
+		}
+		if backoff < bridgeMaxBackoff {
+			backoff *= 2
+		}
+	}
+}
+
+// connect makes one attempt to dial the upstream network, wiring up
+// message relay and nick collision handling and joining b.channel once
+// connected. It returns a channel that closes when the connection drops,
+// or nil if the attempt failed outright and run should back off first.
+func (b *Bridge) connect() <-chan struct{} {
+	cfg := irc.NewConfig(b.localNick())
+	cfg.Server = b.server
+	conn := irc.Client(cfg)
+
+	disconnected := make(chan struct{})
+	conn.HandleFunc(irc.DISCONNECTED, func(*irc.Conn, *irc.Line) {
+		close(disconnected)
+	})
+	conn.HandleFunc(irc.CONNECTED, func(c *irc.Conn, _ *irc.Line) {
+		c.Join(b.channel)
+	})
+	// goirc already handles 433 (nickname in use) by appending "_" and
+	// retrying, so there's no need to register our own handler for it.
+	conn.HandleFunc(irc.PRIVMSG, func(c *irc.Conn, line *irc.Line) {
+		if len(line.Args) < 2 || line.Args[0] != b.channel {
+			return
+		}
+		b.pool.bridgeRelayc <- bridgeRelay{
+			room: b.room,
+			nick: fmt.Sprintf("%s/%s", b.network, line.Nick),
+			text: line.Args[1],
+		}
+	})
+
+	if err := conn.Connect(); err != nil {
+		log.Printf("Bridge %s: connect to %s failed: %s", b.network, b.server, err)
+		return nil
+	}
+	b.setConn(conn)
+	return disconnected
+}
+
+func (b *Bridge) setConn(conn *irc.Conn) {
+	b.connMu.Lock()
+	b.conn = conn
+	b.connMu.Unlock()
+}
+
+// relay queues text, typed locally in b.room by nick, for forwarding
+// upstream to b.channel as a PRIVMSG, prefixed with nick so upstream
+// users can tell bridged users apart. It only queues the line - relayLoop
+// does the actual send - so a wedged upstream network (conn.Privmsg
+// blocking on goirc's own internal, bounded send channel) can't stall
+// pool.Run, the same reason Client writes happen off the dispatch
+// goroutine. If the queue is full, the message is logged and dropped
+// rather than blocking.
+func (b *Bridge) relay(nick, text string) {
+	select {
+	case b.outBuf <- fmt.Sprintf("<%s> %s", nick, text):
+	default:
+		log.Printf("Bridge %s: outbound queue full, dropping message from %s", b.network, nick)
+	}
+}
+
+// relayLoop drains outBuf onto the upstream connection. It is the only
+// goroutine that ever calls Privmsg on b.conn, and runs for the lifetime
+// of the Bridge so it keeps working across reconnects. It's a no-op
+// while the upstream connection is down; the message is simply not
+// relayed rather than queued further.
+func (b *Bridge) relayLoop() {
+	for {
+		select {
+		case line := <-b.outBuf:
+			b.connMu.Lock()
+			conn := b.conn
+			b.connMu.Unlock()
+			if conn != nil {
+				conn.Privmsg(b.channel, line)
+			}
+		case <-b.pool.quitc:
+			return
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+// Channel is a named group of clients that share a topic and receive
+// each other's broadcasts, mirroring the "rooms" concept that IRC
+// daemons such as goircd build their pools around.
+type Channel struct {
+	Name    string
+	Topic   string
+	members map[string]*Client // keyed by client name
+}
+
+func newChannel(name string) *Channel {
+	return &Channel{
+		Name:    name,
+		members: map[string]*Client{},
+	}
+}
+
+func (c *Channel) Join(client *Client) {
+	c.members[client.name] = client
+}
+
+func (c *Channel) Part(name string) {
+	delete(c.members, name)
+}
+
+func (c *Channel) Has(name string) bool {
+	_, ok := c.members[name]
+	return ok
+}
+
+// defaultChannel is where plain line-protocol clients live so that
+// broadcasts between them keep behaving the way they did before channels
+// existed.
+const defaultChannel = "#main"
+
+// getOrCreateChannel returns the named channel, creating it (with no
+// topic set) if this is the first time anyone has joined it.
+func (pool *ConnectionPool) getOrCreateChannel(name string) *Channel {
+	ch, ok := pool.channels[name]
+	if !ok {
+		ch = newChannel(name)
+		pool.channels[name] = ch
+	}
+	return ch
+}
+
+func (pool *ConnectionPool) joinChannel(name string, client *Client) *Channel {
+	ch := pool.getOrCreateChannel(name)
+	ch.Join(client)
+	return ch
+}
+
+func (pool *ConnectionPool) partChannel(name, clientName string) {
+	if ch, ok := pool.channels[name]; ok {
+		ch.Part(clientName)
+	}
+}
+
+// partAllChannels removes a disconnecting client from every channel it was
+// a member of.
+func (pool *ConnectionPool) partAllChannels(clientName string) {
+	for _, ch := range pool.channels {
+		ch.Part(clientName)
+	}
+}
+
+// sendAllInChannel broadcasts text to every member of the named channel,
+// echoing it back to the sender with the "> " prefix used for self-sent
+// lines.
+func (pool *ConnectionPool) sendAllInChannel(channelName, from, text string) {
+	ch, ok := pool.channels[channelName]
+	if !ok {
+		return
+	}
+	for n, client := range ch.members {
+		if n == from {
+			pool.send(client, "> "+text+"\n")
+		} else {
+			pool.send(client, from+"> "+text+"\n")
+		}
+	}
+}
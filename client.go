@@ -0,0 +1,167 @@
+package main
+
+import (
+	"io"
+	"log"
+	"time"
+)
+
+// outBufSize bounds each client's outbound queue. A client that can't
+// keep up and fills this buffer is treated as a slow consumer and
+// evicted, rather than letting its stalled TCP write block broadcasts to
+// everyone else.
+const outBufSize = 128
+
+// writeTimeout bounds how long a single write to a client's connection
+// is allowed to take before that client is considered wedged.
+const writeTimeout = 10 * time.Second
+
+// clientConn is the minimal set of operations a Client needs from its
+// underlying transport. A plain net.Conn satisfies it, and so does
+// anything else the server learns to terminate connections into (an SSH
+// channel, say) — the write deadline is applied on a best-effort basis
+// via a type assertion, since not every transport has one.
+type clientConn interface {
+	io.Writer
+	io.Closer
+}
+
+// Client wraps a connection with its own outbound queue and writer
+// goroutine, mirroring the goircd Client.outBuf design: the pool's single
+// dispatch goroutine never touches the transport directly, so one slow
+// peer can't stall everyone else's messages.
+type Client struct {
+	conn   clientConn
+	name   string // stable identity key: RemoteAddr for TCP, pubkey fingerprint for SSH
+	outBuf chan string
+	done   chan struct{}
+}
+
+func newClient(conn clientConn, name string) *Client {
+	return &Client{
+		conn:   conn,
+		name:   name,
+		outBuf: make(chan string, outBufSize),
+		done:   make(chan struct{}),
+	}
+}
+
+// Send queues a line for delivery and reports whether the queue accepted
+// it. A false return means the client's outbound queue is full and it
+// should be treated as a slow consumer.
+func (c *Client) Send(line string) bool {
+	select {
+	case c.outBuf <- line:
+		return true
+	default:
+		return false
+	}
+}
+
+// writeLoop drains outBuf onto the real connection. It is the only
+// goroutine that ever writes to c.conn.
+func (c *Client) writeLoop() {
+	for {
+		select {
+		case line, ok := <-c.outBuf:
+			if !ok {
+				return
+			}
+			if deadlined, ok := c.conn.(interface{ SetWriteDeadline(time.Time) error }); ok {
+				deadlined.SetWriteDeadline(time.Now().Add(writeTimeout))
+			}
+			if _, err := io.WriteString(c.conn, line); err != nil {
+				c.Close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// Close stops the writer goroutine and closes the underlying connection.
+// Safe to call more than once.
+func (c *Client) Close() {
+	select {
+	case <-c.done:
+	default:
+		close(c.done)
+	}
+	c.conn.Close()
+}
+
+// send formats a line and queues it for client, evicting client if its
+// outbound queue is full.
+func (pool *ConnectionPool) send(client *Client, line string) {
+	if client == nil {
+		return
+	}
+	if !client.Send(line) {
+		log.Printf("Client %s: outbound queue full, evicting", client.name)
+		pool.evict(client)
+	}
+}
+
+// evict removes a client from every map it's tracked in and closes its
+// connection. It's used both for slow-consumer eviction and for
+// keepalive timeouts.
+func (pool *ConnectionPool) evict(client *Client) {
+	pool.partAllChannels(client.name)
+	if nick, ok := pool.nicks[client.name]; ok {
+		if pool.rnicks[nick] == client.name {
+			delete(pool.rnicks, nick)
+		}
+		delete(pool.nicks, client.name)
+	}
+	delete(pool.connections, client.name)
+	delete(pool.protocols, client.name)
+	delete(pool.lastActivity, client.name)
+	delete(pool.pingPending, client.name)
+	delete(pool.ircUsers, client.name)
+	delete(pool.welcomed, client.name)
+	delete(pool.identified, client.name)
+	delete(pool.pendingNick, client.name)
+	client.Close()
+}
+
+// touch records that a client has been heard from, clearing any
+// outstanding keepalive ping.
+func (pool *ConnectionPool) touch(name string) {
+	pool.lastActivity[name] = time.Now()
+	delete(pool.pingPending, name)
+}
+
+// checkKeepalive walks every connected client: those idle for longer
+// than pool.timeout get a PING, and those that already owe a PONG from
+// the last check are evicted as unresponsive. ProtoLine clients have no
+// notion of PONG - any line they send clears pingPending just as well as
+// a PONG would, but a genuinely idle-and-healthy one would otherwise be
+// evicted for never answering a PING it can't parse. The TCP accept loop
+// covers them with its own conn.SetReadDeadline instead, but an SSH
+// channel has no deadline to set, so ProtoLine clients are also evicted
+// here directly once they've been idle twice as long as pool.timeout -
+// the same cutoff the TCP deadline uses - as a backstop for transports
+// that can't enforce a read deadline themselves.
+func (pool *ConnectionPool) checkKeepalive() {
+	now := time.Now()
+	for name, client := range pool.connections {
+		if pool.protocols[name] != ProtoIRC {
+			if now.Sub(pool.lastActivity[name]) >= 2*pool.timeout {
+				log.Printf("Client %s: idle timeout, evicting", name)
+				pool.evict(client)
+			}
+			continue
+		}
+		if now.Sub(pool.lastActivity[name]) < pool.timeout {
+			continue
+		}
+		if pool.pingPending[name] {
+			log.Printf("Client %s: ping timeout, evicting", name)
+			pool.evict(client)
+			continue
+		}
+		pool.pingPending[name] = true
+		pool.send(client, "PING :"+ircServerName+"\r\n")
+	}
+}
@@ -0,0 +1,62 @@
+package command
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Logging logs every command that passes through it before calling the
+// next HandleFunc in the chain.
+func Logging(next HandleFunc) HandleFunc {
+	return func(inv Invocation) error {
+		log.Printf("Command %s: %q", inv.Sender, inv.Cmd)
+		return next(inv)
+	}
+}
+
+// RequireAuth returns middleware that rejects an Invocation with
+// ErrUnauthorized unless allowed reports true for its sender, the way
+// /kick, /ban and /op are gated on pool.isAdmin.
+func RequireAuth(allowed func(sender string) bool) Middleware {
+	return func(next HandleFunc) HandleFunc {
+		return func(inv Invocation) error {
+			if !allowed(inv.Sender) {
+				return ErrUnauthorized
+			}
+			return next(inv)
+		}
+	}
+}
+
+// RateLimit returns middleware that allows a sender at most limit
+// invocations per window, rejecting the rest with an error. Each sender
+// is tracked independently, and entries older than window are pruned on
+// every call, so memory use is bounded by recently-active senders.
+func RateLimit(limit int, window time.Duration) Middleware {
+	var mu sync.Mutex
+	hits := map[string][]time.Time{}
+
+	return func(next HandleFunc) HandleFunc {
+		return func(inv Invocation) error {
+			mu.Lock()
+			now := time.Now()
+			cutoff := now.Add(-window)
+			recent := hits[inv.Sender][:0]
+			for _, t := range hits[inv.Sender] {
+				if t.After(cutoff) {
+					recent = append(recent, t)
+				}
+			}
+			if len(recent) >= limit {
+				hits[inv.Sender] = recent
+				mu.Unlock()
+				return fmt.Errorf("you're sending commands too fast, slow down")
+			}
+			hits[inv.Sender] = append(recent, now)
+			mu.Unlock()
+			return next(inv)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+// Package command provides a pluggable command dispatcher, the way
+// fluffle/goirc dispatches IRC commands to registered Handlers. It has no
+// knowledge of chat-server internals: a Handler reaches whatever state it
+// needs by closing over it, which is what lets code outside this repo
+// register its own commands against a Registry without editing the core
+// server.
+package command
+
+import "fmt"
+
+// Invocation is everything a Handler needs to know about one command
+// call: the command word itself, who sent it, the arguments that
+// followed it, and how to reply to the sender.
+type Invocation struct {
+	Cmd    string
+	Sender string
+	Args   []string
+	Reply  func(line string)
+}
+
+// HandleFunc handles a single command invocation.
+type HandleFunc func(inv Invocation) error
+
+// Handler is a named command that can be registered with a Registry.
+type Handler interface {
+	Name() string
+	Handle(inv Invocation) error
+}
+
+// Middleware wraps a HandleFunc, the way net/http middleware wraps a
+// Handler, so cross-cutting concerns (logging, rate-limiting, auth) can
+// be composed without editing every Handler.
+type Middleware func(HandleFunc) HandleFunc
+
+// Registry maps command names to their middleware-wrapped HandleFunc.
+// The zero value is not usable; construct one with NewRegistry.
+type Registry struct {
+	handlers   map[string]HandleFunc
+	middleware []Middleware
+}
+
+// NewRegistry returns an empty Registry with no middleware.
+func NewRegistry() *Registry {
+	return &Registry{handlers: map[string]HandleFunc{}}
+}
+
+// Use appends mw to the middleware chain applied to every Handler
+// registered after this call. Middleware runs in the order it was added,
+// outermost first, so the first Use call sees an Invocation before the
+// second, and so on down to the Handler itself.
+func (r *Registry) Use(mw Middleware) {
+	r.middleware = append(r.middleware, mw)
+}
+
+// Register adds handler under its Name(), wrapping it in the registry's
+// middleware chain plus any handler-specific extra middleware. A later
+// Register call for the same name replaces the earlier one.
+func (r *Registry) Register(handler Handler, extra ...Middleware) {
+	fn := HandleFunc(handler.Handle)
+	chain := append(append([]Middleware{}, r.middleware...), extra...)
+	for i := len(chain) - 1; i >= 0; i-- {
+		fn = chain[i](fn)
+	}
+	r.handlers[handler.Name()] = fn
+}
+
+// Dispatch invokes the Handler registered for cmd, if any. The bool
+// return reports whether a Handler was found, so callers can tell "no
+// such command" apart from a Handler returning a nil error.
+func (r *Registry) Dispatch(cmd string, inv Invocation) (bool, error) {
+	fn, ok := r.handlers[cmd]
+	if !ok {
+		return false, nil
+	}
+	inv.Cmd = cmd
+	return true, fn(inv)
+}
+
+// ErrUnauthorized is the error RequireAuth reports for a sender its
+// predicate rejects.
+var ErrUnauthorized = fmt.Errorf("You're not authorized to do that")
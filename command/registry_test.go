@@ -0,0 +1,122 @@
+package command_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/simonwistow/go-chat-system/command"
+)
+
+// echoHandler is a minimal Handler implementation, standing in for the
+// kind of command a plugin package outside this repo would register.
+type echoHandler struct {
+	calls int
+}
+
+func (h *echoHandler) Name() string { return "/echo" }
+
+func (h *echoHandler) Handle(inv command.Invocation) error {
+	h.calls++
+	inv.Reply(inv.Sender + ": " + strings.Join(inv.Args, " "))
+	return nil
+}
+
+func TestRegisterAndDispatch(t *testing.T) {
+	r := command.NewRegistry()
+	h := &echoHandler{}
+	r.Register(h)
+
+	var reply string
+	handled, err := r.Dispatch("/echo", command.Invocation{
+		Sender: "alice",
+		Args:   []string{"hello", "world"},
+		Reply:  func(line string) { reply = line },
+	})
+	if !handled {
+		t.Fatal("expected /echo to be handled")
+	}
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if reply != "alice: hello world" {
+		t.Fatalf("unexpected reply: %q", reply)
+	}
+	if h.calls != 1 {
+		t.Fatalf("expected handler to be called once, got %d", h.calls)
+	}
+}
+
+func TestDispatchUnknownCommand(t *testing.T) {
+	r := command.NewRegistry()
+	handled, err := r.Dispatch("/nope", command.Invocation{Sender: "alice"})
+	if handled {
+		t.Fatal("expected /nope to be unhandled")
+	}
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+func TestMiddlewareOrdering(t *testing.T) {
+	r := command.NewRegistry()
+	var order []string
+	mark := func(name string) command.Middleware {
+		return func(next command.HandleFunc) command.HandleFunc {
+			return func(inv command.Invocation) error {
+				order = append(order, name)
+				return next(inv)
+			}
+		}
+	}
+	r.Use(mark("global"))
+	r.Register(&echoHandler{}, mark("extra"))
+
+	if _, err := r.Dispatch("/echo", command.Invocation{Sender: "alice", Reply: func(string) {}}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want := []string{"global", "extra"}; !equal(order, want) {
+		t.Fatalf("middleware ran out of order: got %v, want %v", order, want)
+	}
+}
+
+func TestRequireAuth(t *testing.T) {
+	r := command.NewRegistry()
+	r.Register(&echoHandler{}, command.RequireAuth(func(sender string) bool { return sender == "admin" }))
+
+	_, err := r.Dispatch("/echo", command.Invocation{Sender: "mallory", Reply: func(string) {}})
+	if !errors.Is(err, command.ErrUnauthorized) {
+		t.Fatalf("expected ErrUnauthorized, got %v", err)
+	}
+
+	_, err = r.Dispatch("/echo", command.Invocation{Sender: "admin", Reply: func(string) {}})
+	if err != nil {
+		t.Fatalf("unexpected error for admin sender: %s", err)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	r := command.NewRegistry()
+	r.Register(&echoHandler{}, command.RateLimit(1, time.Minute))
+
+	inv := command.Invocation{Sender: "alice", Reply: func(string) {}}
+	if _, err := r.Dispatch("/echo", inv); err != nil {
+		t.Fatalf("unexpected error on first call: %s", err)
+	}
+	if _, err := r.Dispatch("/echo", inv); err == nil {
+		t.Fatal("expected second call within the window to be rate-limited")
+	}
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/simonwistow/go-chat-system/command"
+)
+
+// registerBuiltinCommands wires up the slash commands this server ships
+// with. It runs once, from newConnectionPool, the same way an external
+// plugin package would register its own commands against pool.commands
+// after constructing the pool.
+func (pool *ConnectionPool) registerBuiltinCommands() {
+	pool.commands = command.NewRegistry()
+	pool.commands.Use(command.Logging)
+	pool.commands.Use(command.RateLimit(5, time.Second))
+
+	pool.commands.Register(&nickCommand{pool})
+	pool.commands.Register(&registerCommand{pool})
+	pool.commands.Register(&identifyCommand{pool})
+	pool.commands.Register(&privmsgCommand{pool})
+	pool.commands.Register(&whoCommand{pool})
+	pool.commands.Register(&kickCommand{pool}, command.RequireAuth(pool.isAdmin))
+	pool.commands.Register(&banCommand{pool}, command.RequireAuth(pool.isAdmin))
+	pool.commands.Register(&opCommand{pool}, command.RequireAuth(pool.isAdmin))
+	pool.commands.Register(&bridgeCommand{pool}, command.RequireAuth(pool.isAdmin))
+}
+
+// nickCommand lets a client set or change their nickname. Claiming a
+// nickname that's already registered requires a follow-up /identify.
+type nickCommand struct{ pool *ConnectionPool }
+
+func (h *nickCommand) Name() string { return "/nick" }
+
+func (h *nickCommand) Handle(inv command.Invocation) error {
+	pool, name := h.pool, inv.Sender
+	nick := pool.nickOrName(name)
+
+	if len(inv.Args) == 0 {
+		return fmt.Errorf("Usage: /nick <nickname>")
+	}
+	if len(inv.Args) > 1 {
+		return fmt.Errorf("Nickname '%s' cannot have spaces in", strings.Join(inv.Args, " "))
+	}
+	newNick := inv.Args[0]
+
+	if remote := pool.connectionFromNickOrName(newNick); remote != nil {
+		inv.Reply(fmt.Sprintf("Nickname '%s' is already taken by %s\n", newNick, remote.name))
+		pool.send(remote, fmt.Sprintf("User '%s' tried to steal your nickname '%s'\n", name, newNick))
+		return nil
+	}
+
+	if _, ok := pool.registrations[newNick]; ok {
+		pool.pendingNick[name] = newNick
+		inv.Reply(fmt.Sprintf("Nickname '%s' is registered; use /identify <password> to claim it\n", newNick))
+		return nil
+	}
+
+	pool.nicks[name] = newNick
+	pool.rnicks[newNick] = name
+	pool.identified[name] = false
+
+	log.Printf("%s has changed their nickname from '%s' to '%s'", name, nick, newNick)
+	pool.sendAllInChannel(defaultChannel, name, fmt.Sprintf("Nickname changed from '%s' to '%s'", nick, newNick))
+	return nil
+}
+
+// registerCommand registers the sender's current nickname so only the
+// password holder can use it from then on.
+type registerCommand struct{ pool *ConnectionPool }
+
+func (h *registerCommand) Name() string { return "/register" }
+
+func (h *registerCommand) Handle(inv command.Invocation) error {
+	pool, name := h.pool, inv.Sender
+	nick := pool.nickOrName(name)
+
+	if len(inv.Args) != 1 {
+		return fmt.Errorf("Usage: /register <password>")
+	}
+	if _, ok := pool.registrations[nick]; ok {
+		return fmt.Errorf("Nickname '%s' is already registered", nick)
+	}
+	pool.registrations[nick] = &registration{passHash: hashPassword(inv.Args[0]), lastSeen: time.Now()}
+	pool.identified[name] = true
+	if err := pool.saveRegistration(nick); err != nil {
+		log.Printf("Failed to persist registration for %s: %s", nick, err)
+	}
+	inv.Reply(fmt.Sprintf("Nickname '%s' registered\n", nick))
+	return nil
+}
+
+// identifyCommand proves ownership of a registered nick, claiming it if
+// it was pending from a collided /nick attempt.
+type identifyCommand struct{ pool *ConnectionPool }
+
+func (h *identifyCommand) Name() string { return "/identify" }
+
+func (h *identifyCommand) Handle(inv command.Invocation) error {
+	pool, name := h.pool, inv.Sender
+	nick := pool.nickOrName(name)
+
+	if len(inv.Args) != 1 {
+		return fmt.Errorf("Usage: /identify <password>")
+	}
+	targetNick, pending := pool.pendingNick[name]
+	if !pending {
+		targetNick = nick
+	}
+	reg, ok := pool.registrations[targetNick]
+	if !ok {
+		return fmt.Errorf("Nickname '%s' is not registered", targetNick)
+	}
+	if subtle.ConstantTimeCompare([]byte(reg.passHash), []byte(hashPassword(inv.Args[0]))) != 1 {
+		return fmt.Errorf("Incorrect password")
+	}
+	if remote := pool.connectionFromNickOrName(targetNick); remote != nil && remote.name != name {
+		return fmt.Errorf("Nickname '%s' is already in use by another session", targetNick)
+	}
+	pool.nicks[name] = targetNick
+	pool.rnicks[targetNick] = name
+	pool.identified[name] = true
+	delete(pool.pendingNick, name)
+	reg.lastSeen = time.Now()
+	if err := pool.saveRegistration(targetNick); err != nil {
+		log.Printf("Failed to persist registration for %s: %s", targetNick, err)
+	}
+	inv.Reply(fmt.Sprintf("Identified as '%s'\n", targetNick))
+	return nil
+}
+
+// privmsgCommand sends a private message to another client by nick or
+// identity.
+type privmsgCommand struct{ pool *ConnectionPool }
+
+func (h *privmsgCommand) Name() string { return "/privmsg" }
+
+func (h *privmsgCommand) Handle(inv command.Invocation) error {
+	pool, name := h.pool, inv.Sender
+	nick := pool.nickOrName(name)
+	client := pool.connections[name]
+	if len(inv.Args) == 0 {
+		return fmt.Errorf("Usage: /privmsg <nick> <message>")
+	}
+	rnick, text := inv.Args[0], strings.Join(inv.Args[1:], " ")
+	log.Printf("User %s sending a privmsg to %s", nick, rnick)
+
+	remote := pool.connectionFromNickOrName(rnick)
+	if remote == nil {
+		inv.Reply(fmt.Sprintf("Couldn't find a person named '%s'\n", rnick))
+	} else if remote == client {
+		inv.Reply("You can't privmsg yourself\n")
+	} else {
+		pool.send(remote, fmt.Sprintf("%s (private)> %s\n", nick, text))
+		inv.Reply("Message sent\n")
+	}
+	return nil
+}
+
+// whoCommand lists every connected client, marking the sender's own
+// entry.
+type whoCommand struct{ pool *ConnectionPool }
+
+func (h *whoCommand) Name() string { return "/who" }
+
+func (h *whoCommand) Handle(inv command.Invocation) error {
+	pool := h.pool
+	client := pool.connections[inv.Sender]
+	var names []string
+	for name, c := range pool.connections {
+		if nick, ok := pool.nicks[name]; ok {
+			name = fmt.Sprintf("%s (%s)", nick, name)
+		}
+		if c == client {
+			name += " *"
+		}
+		names = append(names, name)
+	}
+	inv.Reply(strings.Join(names, "\n") + "\n")
+	return nil
+}
+
+// kickCommand disconnects a user. Admin-only, enforced by the
+// command.RequireAuth middleware it's registered with.
+type kickCommand struct{ pool *ConnectionPool }
+
+func (h *kickCommand) Name() string { return "/kick" }
+
+func (h *kickCommand) Handle(inv command.Invocation) error {
+	pool := h.pool
+	if len(inv.Args) == 0 {
+		return fmt.Errorf("Usage: /kick <nick>")
+	}
+	target := pool.connectionFromNickOrName(inv.Args[0])
+	if target == nil {
+		return fmt.Errorf("Couldn't find a person named '%s'", inv.Args[0])
+	}
+	pool.send(target, "You have been kicked\n")
+	pool.evict(target)
+	return nil
+}
+
+// banCommand kicks a user and refuses their identity from then on.
+// Admin-only, enforced by the command.RequireAuth middleware it's
+// registered with.
+type banCommand struct{ pool *ConnectionPool }
+
+func (h *banCommand) Name() string { return "/ban" }
+
+func (h *banCommand) Handle(inv command.Invocation) error {
+	pool := h.pool
+	if len(inv.Args) == 0 {
+		return fmt.Errorf("Usage: /ban <nick>")
+	}
+	target := pool.connectionFromNickOrName(inv.Args[0])
+	if target == nil {
+		return fmt.Errorf("Couldn't find a person named '%s'", inv.Args[0])
+	}
+	pool.banned[target.name] = true
+	pool.send(target, "You have been banned\n")
+	pool.evict(target)
+	return nil
+}
+
+// opCommand grants another client operator status. Admin-only, enforced
+// by the command.RequireAuth middleware it's registered with.
+type opCommand struct{ pool *ConnectionPool }
+
+func (h *opCommand) Name() string { return "/op" }
+
+func (h *opCommand) Handle(inv command.Invocation) error {
+	pool := h.pool
+	if len(inv.Args) == 0 {
+		return fmt.Errorf("Usage: /op <nick>")
+	}
+	target := pool.connectionFromNickOrName(inv.Args[0])
+	if target == nil {
+		return fmt.Errorf("Couldn't find a person named '%s'", inv.Args[0])
+	}
+	pool.ops[target.name] = true
+	pool.send(target, "You have been made an operator\n")
+	return nil
+}
+
+// bridgeCommand starts relaying a channel on an upstream IRC network
+// into a local room. Admin-only, enforced by the command.RequireAuth
+// middleware it's registered with.
+type bridgeCommand struct{ pool *ConnectionPool }
+
+func (h *bridgeCommand) Name() string { return "/bridge" }
+
+func (h *bridgeCommand) Handle(inv command.Invocation) error {
+	pool := h.pool
+	if len(inv.Args) != 3 {
+		return fmt.Errorf("Usage: /bridge <network> <server:port> <channel>")
+	}
+	network, server, channel := inv.Args[0], inv.Args[1], inv.Args[2]
+	bridge := newBridge(pool, network, server, channel)
+	if _, exists := pool.bridges[bridge.room]; exists {
+		return fmt.Errorf("Bridge '%s' is already running", network)
+	}
+	pool.bridges[bridge.room] = bridge
+	pool.getOrCreateChannel(bridge.room)
+	go bridge.run()
+	inv.Reply(fmt.Sprintf("Bridging %s on %s to %s; join %s to talk\n", channel, network, server, bridge.room))
+	return nil
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/simonwistow/go-chat-system/command"
+)
+
+// ClientProtocol is the wire protocol a connection is speaking. It is
+// auto-detected from the first bytes a client sends, so the server can
+// happily serve the original plain line protocol and a subset of RFC 1459
+// IRC side by side on the same listener.
+type ClientProtocol int
+
+const (
+	ProtoLine ClientProtocol = iota
+	ProtoIRC
+)
+
+// ircServerName is used as the prefix on numeric replies and server
+// notices, the way a real ircd would use its configured server name.
+const ircServerName = "go-chat-system"
+
+// ircCommandPrefixes are the first words of the IRC commands a client is
+// likely to open a session with. Seeing one of these as the first line
+// from a new connection is enough to tell it apart from the plain line
+// protocol, which has no such structure.
+var ircCommandPrefixes = []string{"NICK ", "USER ", "PASS ", "CAP "}
+
+// detectProtocol classifies a connection's first line, so the caller can
+// decide which protocol handler to wire it up to. It takes the line
+// itself (rather than peeking at the raw connection) so detection never
+// has to wait on more bytes than the client has actually sent.
+func detectProtocol(firstLine string) ClientProtocol {
+	upper := strings.ToUpper(firstLine)
+	for _, prefix := range ircCommandPrefixes {
+		if strings.HasPrefix(upper, prefix) {
+			return ProtoIRC
+		}
+	}
+	return ProtoLine
+}
+
+// ircLine writes a raw ":prefix COMMAND params..." line, the shape every
+// message on the wire takes in RFC 1459.
+func ircLineText(prefix, command string, params ...string) string {
+	line := fmt.Sprintf(":%s %s", prefix, command)
+	if len(params) > 0 {
+		line += " " + strings.Join(params, " ")
+	}
+	return line + "\r\n"
+}
+
+// ircReply queues a numeric reply from the server, in the usual ":server
+// CODE target params..." shape.
+func (pool *ConnectionPool) ircReply(client *Client, code, target string, params ...string) {
+	pool.send(client, ircLineText(ircServerName, code, append([]string{target}, params...)...))
+}
+
+// ircRelay queues a command as if it came from fromNick, the shape used
+// to tell other clients about a NICK change, JOIN, PART or PRIVMSG.
+func (pool *ConnectionPool) ircRelay(client *Client, fromNick, command string, params ...string) {
+	pool.send(client, ircLineText(fromNick, command, params...))
+}
+
+// ircLine is a parsed IRC protocol line: a command verb and its
+// parameters, with the trailing ":"-prefixed parameter (if any) kept as a
+// single final element.
+type ircLine struct {
+	command string
+	params  []string
+}
+
+func parseIRCLine(text string) ircLine {
+	text = strings.TrimPrefix(text, ":")
+	if idx := strings.Index(text, " :"); idx != -1 {
+		head, trailing := text[:idx], text[idx+2:]
+		fields := strings.Fields(head)
+		if len(fields) == 0 {
+			return ircLine{}
+		}
+		return ircLine{command: fields[0], params: append(fields[1:], trailing)}
+	}
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return ircLine{}
+	}
+	return ircLine{command: fields[0], params: fields[1:]}
+}
+
+// ircNick returns the current nickname for a client, falling back to "*"
+// the way unregistered IRC clients are addressed before NICK succeeds.
+func (pool *ConnectionPool) ircNick(name string) string {
+	if nick, ok := pool.nicks[name]; ok && nick != "" {
+		return nick
+	}
+	return "*"
+}
+
+// maybeWelcomeIRCClient sends the registration burst once a client has
+// sent both NICK and USER, mirroring the 001-004 numerics a real ircd
+// sends before a client is usable.
+func (pool *ConnectionPool) maybeWelcomeIRCClient(client *Client) {
+	name := client.name
+	if pool.welcomed[name] || pool.nicks[name] == "" || !pool.ircUsers[name] {
+		return
+	}
+	pool.welcomed[name] = true
+	nick := pool.nicks[name]
+	pool.ircReply(client, "001", nick, fmt.Sprintf(":Welcome to %s, %s", ircServerName, nick))
+	pool.ircReply(client, "002", nick, fmt.Sprintf(":Your host is %s", ircServerName))
+	pool.ircReply(client, "003", nick, ":This server has no uptime tracking")
+	pool.ircReply(client, "004", nick, ircServerName, "go-chat-system-0", "o", "o")
+}
+
+func (pool *ConnectionPool) handleIRCCommand(message Message) {
+	name := message.name
+	client := pool.connections[name]
+	if client == nil {
+		return
+	}
+	line := parseIRCLine(message.message)
+
+	if line.command == "" {
+		return
+	}
+
+	log.Printf("IRC command %s: \"%s\"", name, line.command)
+
+	switch strings.ToUpper(line.command) {
+	case "NICK":
+		pool.handleIRCNick(client, line.params)
+	case "USER":
+		pool.ircUsers[name] = true
+		pool.maybeWelcomeIRCClient(client)
+	case "JOIN":
+		pool.handleIRCJoin(client, line.params)
+	case "PART":
+		pool.handleIRCPart(client, line.params)
+	case "TOPIC":
+		pool.handleIRCTopic(client, line.params)
+	case "PRIVMSG":
+		pool.handleIRCPrivmsg(client, line.params)
+	case "NAMES":
+		pool.handleIRCNames(client, line.params)
+	case "WHO":
+		pool.handleIRCWho(client, line.params)
+	case "PING":
+		pool.send(client, ircLineText(ircServerName, "PONG", append([]string{ircServerName}, line.params...)...))
+	case "PONG":
+		// any inbound line already clears the pending keepalive ping.
+	case "WALLOPS":
+		pool.handleIRCWallops(client, line.params)
+	case "QUIT":
+		pool.evict(client)
+	default:
+		pool.ircReply(client, "421", pool.ircNick(name), line.command, ":Unknown command")
+	}
+}
+
+func (pool *ConnectionPool) handleIRCNick(client *Client, params []string) {
+	name := client.name
+	if len(params) == 0 {
+		pool.ircReply(client, "431", pool.ircNick(name), ":No nickname given")
+		return
+	}
+	newNick := params[0]
+	if remote := pool.connectionFromNickOrName(newNick); remote != nil && remote != client {
+		pool.ircReply(client, "433", pool.ircNick(name), newNick, ":Nickname is already in use")
+		return
+	}
+	if _, ok := pool.registrations[newNick]; ok {
+		pool.pendingNick[name] = newNick
+		pool.ircReply(client, "433", pool.ircNick(name), newNick, ":Nickname is registered; use /identify <password> to claim it")
+		return
+	}
+	oldNick := pool.ircNick(name)
+	pool.nicks[name] = newNick
+	pool.rnicks[newNick] = name
+	pool.identified[name] = false
+	if oldNick != "*" {
+		pool.ircRelay(client, oldNick, "NICK", ":"+newNick)
+	}
+	pool.maybeWelcomeIRCClient(client)
+}
+
+func (pool *ConnectionPool) handleIRCJoin(client *Client, params []string) {
+	name := client.name
+	if len(params) == 0 {
+		pool.ircReply(client, "461", pool.ircNick(name), "JOIN", ":Not enough parameters")
+		return
+	}
+	nick := pool.ircNick(name)
+	for _, chanName := range strings.Split(params[0], ",") {
+		ch := pool.joinChannel(chanName, client)
+		for _, member := range ch.members {
+			pool.ircRelay(member, nick, "JOIN", chanName)
+		}
+		if ch.Topic != "" {
+			pool.ircReply(client, "332", nick, chanName, ":"+ch.Topic)
+		}
+		pool.sendIRCNames(client, nick, ch)
+	}
+}
+
+func (pool *ConnectionPool) handleIRCPart(client *Client, params []string) {
+	name := client.name
+	if len(params) == 0 {
+		pool.ircReply(client, "461", pool.ircNick(name), "PART", ":Not enough parameters")
+		return
+	}
+	nick := pool.ircNick(name)
+	for _, chanName := range strings.Split(params[0], ",") {
+		ch, ok := pool.channels[chanName]
+		if !ok || !ch.Has(name) {
+			pool.ircReply(client, "442", nick, chanName, ":You're not on that channel")
+			continue
+		}
+		for _, member := range ch.members {
+			pool.ircRelay(member, nick, "PART", chanName)
+		}
+		pool.partChannel(chanName, name)
+	}
+}
+
+// handleIRCTopic views or sets a channel's topic: with one parameter it
+// replies with the current topic (or 331 if none is set), and with two it
+// sets the topic and relays the change to every member, the way a real
+// ircd's TOPIC command behaves.
+func (pool *ConnectionPool) handleIRCTopic(client *Client, params []string) {
+	name := client.name
+	if len(params) == 0 {
+		pool.ircReply(client, "461", pool.ircNick(name), "TOPIC", ":Not enough parameters")
+		return
+	}
+	nick := pool.ircNick(name)
+	chanName := params[0]
+	ch, ok := pool.channels[chanName]
+	if !ok || !ch.Has(name) {
+		pool.ircReply(client, "442", nick, chanName, ":You're not on that channel")
+		return
+	}
+	if len(params) == 1 {
+		if ch.Topic == "" {
+			pool.ircReply(client, "331", nick, chanName, ":No topic is set")
+		} else {
+			pool.ircReply(client, "332", nick, chanName, ":"+ch.Topic)
+		}
+		return
+	}
+	ch.Topic = params[1]
+	for _, member := range ch.members {
+		pool.ircRelay(member, nick, "TOPIC", chanName, ":"+ch.Topic)
+	}
+}
+
+func (pool *ConnectionPool) handleIRCPrivmsg(client *Client, params []string) {
+	name := client.name
+	if len(params) < 2 {
+		pool.ircReply(client, "461", pool.ircNick(name), "PRIVMSG", ":Not enough parameters")
+		return
+	}
+	target, text := params[0], params[1]
+	nick := pool.ircNick(name)
+
+	if strings.HasPrefix(text, "/") {
+		pool.handleIRCSlashCommand(client, text)
+		return
+	}
+
+	if strings.HasPrefix(target, "#") {
+		ch, ok := pool.channels[target]
+		if !ok {
+			pool.ircReply(client, "403", nick, target, ":No such channel")
+			return
+		}
+		for n, member := range ch.members {
+			if n != name {
+				pool.ircRelay(member, nick, "PRIVMSG", target, ":"+text)
+			}
+		}
+		if bridge, ok := pool.bridges[target]; ok {
+			bridge.relay(nick, text)
+		}
+		return
+	}
+
+	remote := pool.connectionFromNickOrName(target)
+	if remote == nil {
+		pool.ircReply(client, "401", nick, target, ":No such nick")
+		return
+	}
+	pool.ircRelay(remote, nick, "PRIVMSG", target, ":"+text)
+}
+
+// handleIRCSlashCommand lets an IRC client reach the same command
+// registry handleCommand dispatches for the line protocol. A real IRC
+// client has no native concept of "/identify" or "/register" - anything
+// it doesn't recognize as a built-in client command (which a "/"-prefixed
+// word almost never is) just goes out as ordinary PRIVMSG text, which is
+// why this is reached from handleIRCPrivmsg rather than the command
+// switch in handleIRCCommand. Replies come back as NOTICEs from
+// ircServerName instead of the raw lines the line protocol gets.
+func (pool *ConnectionPool) handleIRCSlashCommand(client *Client, text string) {
+	name := client.name
+	nick := pool.ircNick(name)
+	parts := strings.Split(text, " ")
+	cmd, args := parts[0], parts[1:]
+
+	inv := command.Invocation{
+		Sender: name,
+		Args:   args,
+		Reply: func(line string) {
+			for _, l := range strings.Split(strings.TrimRight(line, "\n"), "\n") {
+				pool.ircReply(client, "NOTICE", nick, ":"+l)
+			}
+		},
+	}
+	handled, err := pool.commands.Dispatch(cmd, inv)
+	if !handled {
+		pool.ircReply(client, "421", nick, cmd, ":Unknown command")
+		return
+	}
+	if err != nil {
+		pool.ircReply(client, "NOTICE", nick, ":"+err.Error())
+	}
+}
+
+func (pool *ConnectionPool) sendIRCNames(client *Client, nick string, ch *Channel) {
+	var names []string
+	for clientName := range ch.members {
+		names = append(names, pool.ircNick(clientName))
+	}
+	pool.ircReply(client, "353", nick, "=", ch.Name, ":"+strings.Join(names, " "))
+	pool.ircReply(client, "366", nick, ch.Name, ":End of /NAMES list")
+}
+
+func (pool *ConnectionPool) handleIRCNames(client *Client, params []string) {
+	nick := pool.ircNick(client.name)
+	if len(params) == 0 {
+		for _, ch := range pool.channels {
+			pool.sendIRCNames(client, nick, ch)
+		}
+		return
+	}
+	if ch, ok := pool.channels[params[0]]; ok {
+		pool.sendIRCNames(client, nick, ch)
+	}
+}
+
+func (pool *ConnectionPool) handleIRCWho(client *Client, params []string) {
+	nick := pool.ircNick(client.name)
+	members := pool.connections
+	if len(params) > 0 {
+		if ch, ok := pool.channels[params[0]]; ok {
+			members = ch.members
+		}
+	}
+	for clientName := range members {
+		who := pool.ircNick(clientName)
+		pool.ircReply(client, "352", nick, "*", who, ircServerName, ircServerName, who, "H", ":0 "+who)
+	}
+	pool.ircReply(client, "315", nick, "*", ":End of /WHO list")
+}
+
+func (pool *ConnectionPool) handleIRCWallops(client *Client, params []string) {
+	if len(params) == 0 {
+		return
+	}
+	nick := pool.ircNick(client.name)
+	for _, other := range pool.connections {
+		pool.ircRelay(other, nick, "WALLOPS", ":"+params[len(params)-1])
+	}
+}
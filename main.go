@@ -8,24 +8,40 @@ import (
 	"log"
 	"net"
 	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/simonwistow/go-chat-system/command"
 )
 
 func main() {
 	var (
-		mode = flag.String("mode", "server", "Whether to run as server or client")
-		addr = flag.String("address", "127.0.0.1:8888", "address to connect to")
+		mode      = flag.String("mode", "server", "Whether to run as server or client")
+		addr      = flag.String("address", "127.0.0.1:8888", "address to connect to")
+		keepalive = flag.Duration("keepalive", 60*time.Second, "how long a client may stay idle before being pinged and, if unresponsive, evicted")
+		transport = flag.String("transport", "tcp", "Transport to serve on: tcp or ssh")
+		identity  = flag.String("identity", "", "path to the SSH host key (required for -transport=ssh)")
+		admin     = flag.String("admin", "", "SSH pubkey fingerprint allowed to use /kick, /ban and /op")
+		whitelist = flag.String("whitelist", "", "path to a file of SSH pubkey fingerprints allowed to connect")
+		stateDir  = flag.String("state-dir", "", "directory to persist nick registrations in (unset disables persistence)")
 	)
 	flag.Parse()
 
 	var err error
 	switch {
-	case strings.ToLower(*mode) == "server":
-		err = runServer(*addr)
 	case strings.ToLower(*mode) == "client":
 		err = runClient(*addr)
-	default:
+	case strings.ToLower(*mode) != "server":
 		err = errors.New("Mode must be server or client")
+	case strings.ToLower(*transport) == "ssh":
+		err = runSSHServer(*addr, *identity, *admin, *whitelist, *stateDir, *keepalive)
+	case strings.ToLower(*transport) == "tcp":
+		err = runServer(*addr, *stateDir, *keepalive)
+	default:
+		err = errors.New("Transport must be tcp or ssh")
 	}
 	if err != nil {
 		log.Fatalf("%s", err)
@@ -33,68 +49,170 @@ func main() {
 }
 
 type ConnectionPool struct {
-	connections map[string]net.Conn
-	nicks       map[string]string
-	rnicks      map[string]string
-	connectc    chan net.Conn
-	disconnectc chan net.Conn
-	broadcastc  chan Message
-	quitc       chan struct{}
+	connections   map[string]*Client
+	nicks         map[string]string
+	rnicks        map[string]string
+	protocols     map[string]ClientProtocol
+	channels      map[string]*Channel
+	ircUsers      map[string]bool          // name -> USER command received
+	welcomed      map[string]bool          // name -> registration burst sent
+	lastActivity  map[string]time.Time     // name -> last time a line was received
+	pingPending   map[string]bool          // name -> keepalive PING sent, awaiting activity
+	timeout       time.Duration            // idle time before a keepalive PING, and again before eviction
+	admin         string                   // fingerprint of the -admin user, if running under SSH transport
+	ops           map[string]bool          // fingerprints granted operator status via /op
+	banned        map[string]bool          // fingerprints refused at SSH handshake time
+	stateDir      string                   // where nick registrations are persisted; empty disables persistence
+	registrations map[string]*registration // nick -> password hash + last-seen, loaded from stateDir
+	pendingNick   map[string]string        // name -> registered nick awaiting /identify
+	identified    map[string]bool          // name -> currently holding a nick it has proven ownership of
+	commands      *command.Registry        // slash command dispatch table, see commands.go
+	bridges       map[string]*Bridge       // local room name -> the Bridge relaying it, see bridge.go
+	connectc      chan *pendingConn
+	disconnectc   chan *Client
+	broadcastc    chan Message
+	bridgeRelayc  chan bridgeRelay // upstream messages, from a Bridge's goirc callbacks into Run
+	quitc         chan struct{}
+	shutdownc     chan string // buffered(1): optional farewell message for Shutdown to hand to Run
+	shutdownOnce  sync.Once
 }
 
 type Message struct {
-	connection net.Conn
-	message    string
+	name    string // identity of the sending client, see pendingConn.name
+	message string
 }
 
-func newConnectionPool() *ConnectionPool {
-	return &ConnectionPool{
-		connections: map[string]net.Conn{},
-		nicks:       map[string]string{},
-		rnicks:      map[string]string{},
-		connectc:    make(chan net.Conn),
-		disconnectc: make(chan net.Conn),
-		broadcastc:  make(chan Message),
-		quitc:       make(chan struct{}),
+// pendingConn carries a freshly-accepted connection, the identity it
+// should be tracked under (RemoteAddr for TCP, pubkey fingerprint for
+// SSH), and the protocol detectProtocol decided it's speaking, from the
+// accept loop to the pool's Run goroutine. created is how Run hands the
+// *Client it builds back to the caller of Add.
+type pendingConn struct {
+	conn    clientConn
+	name    string
+	proto   ClientProtocol
+	created chan *Client
+}
+
+func newConnectionPool(timeout time.Duration) *ConnectionPool {
+	pool := &ConnectionPool{
+		connections:   map[string]*Client{},
+		nicks:         map[string]string{},
+		rnicks:        map[string]string{},
+		protocols:     map[string]ClientProtocol{},
+		channels:      map[string]*Channel{},
+		ircUsers:      map[string]bool{},
+		welcomed:      map[string]bool{},
+		lastActivity:  map[string]time.Time{},
+		pingPending:   map[string]bool{},
+		timeout:       timeout,
+		ops:           map[string]bool{},
+		banned:        map[string]bool{},
+		registrations: map[string]*registration{},
+		pendingNick:   map[string]string{},
+		identified:    map[string]bool{},
+		bridges:       map[string]*Bridge{},
+		connectc:      make(chan *pendingConn),
+		disconnectc:   make(chan *Client),
+		broadcastc:    make(chan Message),
+		bridgeRelayc:  make(chan bridgeRelay),
+		quitc:         make(chan struct{}),
+		shutdownc:     make(chan string, 1),
 	}
+	pool.registerBuiltinCommands()
+	return pool
 }
 
-func (pool *ConnectionPool) Add(conn net.Conn) {
-	pool.connectc <- conn
+// Add registers a freshly-accepted connection under name and returns the
+// *Client Run created for it, which the caller must pass to Delete when
+// the connection closes. If name is already connected, the existing
+// session is closed and replaced rather than silently overwritten.
+func (pool *ConnectionPool) Add(conn clientConn, name string, proto ClientProtocol) *Client {
+	created := make(chan *Client, 1)
+	pool.connectc <- &pendingConn{conn: conn, name: name, proto: proto, created: created}
+	return <-created
 }
 
-func (pool *ConnectionPool) Delete(conn net.Conn) {
-	pool.disconnectc <- conn
+// Delete evicts client, but only if it's still the one registered under
+// its name - a Delete for a session that's already been replaced by a
+// newer one with the same name (a second SSH session from the same
+// pubkey, say) is a no-op rather than evicting the newer session.
+func (pool *ConnectionPool) Delete(client *Client) {
+	pool.disconnectc <- client
 }
 
-func (pool *ConnectionPool) Broadcast(conn net.Conn, message string) {
-	pool.broadcastc <- Message{connection: conn, message: message}
+func (pool *ConnectionPool) Broadcast(name string, message string) {
+	pool.broadcastc <- Message{name: name, message: message}
 }
 
-func (pool *ConnectionPool) Shutdown() {
-	close(pool.quitc)
+// Shutdown stops Run, optionally delivering a farewell message to every
+// connected client first. Safe to call more than once (only the first
+// call has any effect), so both a deferred cleanup and an explicit
+// signal-triggered shutdown can call it without double-closing quitc.
+func (pool *ConnectionPool) Shutdown(message string) {
+	pool.shutdownOnce.Do(func() {
+		if message != "" {
+			pool.shutdownc <- message
+		}
+		close(pool.quitc)
+	})
 }
 
 func (pool *ConnectionPool) Run() {
+	ticker := time.NewTicker(pool.timeout / 2)
+	defer ticker.Stop()
+
 	for {
 		select {
-		case conn := <-pool.connectc:
-			name := conn.RemoteAddr().String()
-			log.Printf("Client %s: connected", name)
-			pool.connections[name] = conn
-		case conn := <-pool.disconnectc:
-			name := conn.RemoteAddr().String()
-			log.Printf("Client %s: disconnected", name)
-			delete(pool.connections, name)
+		case pc := <-pool.connectc:
+			if existing, ok := pool.connections[pc.name]; ok {
+				log.Printf("Client %s: new session replacing existing connection", pc.name)
+				pool.evict(existing)
+			}
+			client := newClient(pc.conn, pc.name)
+			go client.writeLoop()
+			log.Printf("Client %s: connected", client.name)
+			pool.connections[client.name] = client
+			pool.protocols[client.name] = pc.proto
+			pool.touch(client.name)
+			if pc.proto == ProtoLine {
+				pool.joinChannel(defaultChannel, client)
+			}
+			pc.created <- client
+		case client := <-pool.disconnectc:
+			if pool.connections[client.name] == client {
+				name := client.name
+				log.Printf("Client %s: disconnected", name)
+				pool.evict(client)
+			}
 		case message := <-pool.broadcastc:
-			if strings.HasPrefix(message.message, "/") {
+			name := message.name
+			if _, ok := pool.connections[name]; !ok {
+				continue
+			}
+			pool.touch(name)
+			switch {
+			case pool.protocols[name] == ProtoIRC:
+				pool.handleIRCCommand(message)
+			case strings.HasPrefix(message.message, "/"):
 				pool.handleCommand(message)
-			} else {
+			default:
 				pool.handleMessage(message)
 			}
+		case relay := <-pool.bridgeRelayc:
+			pool.sendAllInChannel(relay.room, relay.nick, relay.text)
+		case <-ticker.C:
+			pool.checkKeepalive()
 		case <-pool.quitc:
-			for _, conn := range pool.connections {
-				conn.Close()
+			select {
+			case message := <-pool.shutdownc:
+				for _, client := range pool.connections {
+					pool.send(client, message)
+				}
+			default:
+			}
+			for _, client := range pool.connections {
+				client.Close()
 			}
 			return
 		}
@@ -102,113 +220,75 @@ func (pool *ConnectionPool) Run() {
 
 }
 
-func (pool *ConnectionPool) getNames(message Message) (string, string) {
-	name := message.connection.RemoteAddr().String()
-	nick := pool.nicks[name]
-	if nick == "" {
-		nick = name
+// nickOrName returns name's current nickname, or name itself if it
+// hasn't set one yet.
+func (pool *ConnectionPool) nickOrName(name string) string {
+	if nick, ok := pool.nicks[name]; ok && nick != "" {
+		return nick
 	}
-	return name, nick
+	return name
 }
 
-func (pool *ConnectionPool) handleCommand(message Message) {
-	name, nick := pool.getNames(message)
-	text := message.message
-	// clean off the command from the start of the message
-	parts := strings.Split(text, " ")
-	cmd, parts := parts[0], parts[1:]
-
-	log.Printf("Command %s: \"%s\"", name, cmd)
-
-	switch {
-	// Allow setting and changing of nicknames
-	case cmd == "/nick":
-		// nicks must be one word
-		if len(parts) > 1 {
-			fmt.Fprintf(message.connection, "Nickname '%s' cannot have spaces in\n", strings.Join(parts, " "))
-			return
-		}
-
-		// clean off the command from the start of the message
-		newNick := parts[0]
-
-		// check to see if the nickname is already taken - if it is tell the requester and the owner
-		if remote := pool.connectionFromNickOrName(newNick); remote != nil {
-			fmt.Fprintf(message.connection, "Nickname '%s' is already taken by %s\n", newNick, remote.RemoteAddr().String())
-			fmt.Fprintf(remote, "User '%s' tried to steal your nickname '%s'\n", name, newNick)
-			return
-		}
-
-		pool.nicks[name] = newNick
-		pool.rnicks[newNick] = message.connection.RemoteAddr().String()
-
-		log.Printf("%s has changed their nickname from '%s' to '%s'", name, nick, newNick)
-		pool.sendAll(name, fmt.Sprintf("Nickname changed from '%s' to '%s'", nick, newNick))
-	// Allow sending private messages
-	case cmd == "/privmsg":
-		rnick, text := parts[0], strings.Join(parts[1:], " ")
-		log.Printf("User %s sending a privmsg to %s", nick, rnick)
-
-		remote := pool.connectionFromNickOrName(rnick)
-		if remote == nil {
-			fmt.Fprintf(message.connection, "Couldn't find a person named '%s'\n", rnick)
-		} else if remote == message.connection {
-			fmt.Fprintf(message.connection, "You can't privmsg yourself\n")
-		} else {
-			fmt.Fprintf(remote, "%s (private)> %s\n", nick, text)
-			fmt.Fprintf(message.connection, "Message sent\n")
-		}
-	// Allow listing of all users
-	case cmd == "/who":
-		var names []string
+func (pool *ConnectionPool) getNames(message Message) (string, string) {
+	name := message.name
+	return name, pool.nickOrName(name)
+}
 
-		// loop through all connections
-		for name, c := range pool.connections {
-			// lookup the nickname if applicable
-			if nick, ok := pool.nicks[name]; ok {
-				name = fmt.Sprintf("%s (%s)", nick, name)
-			}
-			if c == message.connection {
-				name += " *"
-			}
-			names = append(names, name)
-		}
-		fmt.Fprintf(message.connection, "%s\n", strings.Join(names, "\n"))
-	default:
-		fmt.Fprintf(message.connection, "Unknown command %s\n", cmd)
+// handleCommand parses a "/command arg arg..." line and dispatches it
+// through pool.commands, the registry built-in commands and any
+// externally-registered ones share. See commands.go for the built-ins.
+func (pool *ConnectionPool) handleCommand(message Message) {
+	name := message.name
+	client := pool.connections[name]
+	parts := strings.Split(message.message, " ")
+	cmd, args := parts[0], parts[1:]
+
+	inv := command.Invocation{
+		Sender: name,
+		Args:   args,
+		Reply:  func(line string) { pool.send(client, line) },
+	}
+	handled, err := pool.commands.Dispatch(cmd, inv)
+	if !handled {
+		pool.send(client, fmt.Sprintf("Unknown command %s\n", cmd))
+		return
+	}
+	if err != nil {
+		pool.send(client, fmt.Sprintf("%s\n", err))
 	}
-
-	return
 }
 
 func (pool *ConnectionPool) handleMessage(message Message) {
 	name, nick := pool.getNames(message)
 	text := message.message
 	log.Printf("Message %s: \"%s\"", name, text)
-	pool.sendAll(nick, text)
+	pool.sendAllInChannel(defaultChannel, nick, text)
 }
 
-func (pool *ConnectionPool) sendAll(from string, text string) {
-	for n, c := range pool.connections {
-		if n == from {
-			fmt.Fprintf(c, "> %s\n", text)
-		} else {
-			fmt.Fprintf(c, "%s> %s\n", from, text)
-		}
-	}
+// isAdmin reports whether name (a client's identity, which is only a
+// meaningful fingerprint under the SSH transport) is the configured
+// -admin or has been granted operator status with /op.
+func (pool *ConnectionPool) isAdmin(name string) bool {
+	return name != "" && (name == pool.admin || pool.ops[name])
 }
 
-func (pool *ConnectionPool) connectionFromNickOrName(name string) net.Conn {
+func (pool *ConnectionPool) connectionFromNickOrName(name string) *Client {
 	if tmp, ok := pool.rnicks[name]; ok {
 		name = tmp
 	}
 	return pool.connections[name]
 }
 
-func runServer(address string) error {
+func runServer(address, stateDir string, keepalive time.Duration) error {
 	var err error
-	var pool = newConnectionPool()
-	defer pool.Shutdown()
+	var pool = newConnectionPool(keepalive)
+	pool.stateDir = stateDir
+	if stateDir != "" {
+		if err := pool.loadState(); err != nil {
+			return err
+		}
+	}
+	defer pool.Shutdown("")
 	go pool.Run()
 
 	ln, err := net.Listen("tcp", address)
@@ -218,18 +298,36 @@ func runServer(address string) error {
 	defer ln.Close()
 	log.Printf("Listening on %s", address)
 
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigc
+		log.Printf("Received shutdown signal")
+		pool.Shutdown("Server is shutting down, goodbye!\n")
+		ln.Close()
+	}()
+
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
 			break
 		}
 		go func() {
-			pool.Add(conn)
-			defer pool.Delete(conn)
+			name := conn.RemoteAddr().String()
+			conn.SetReadDeadline(time.Now().Add(2 * keepalive))
 			scanner := bufio.NewScanner(conn)
+			if !scanner.Scan() {
+				return
+			}
+			proto := detectProtocol(scanner.Text())
+			client := pool.Add(conn, name, proto)
+			defer pool.Delete(client)
+			pool.Broadcast(name, scanner.Text())
+			conn.SetReadDeadline(time.Now().Add(2 * keepalive))
 			for scanner.Scan() {
 				text := scanner.Text()
-				pool.Broadcast(conn, text)
+				pool.Broadcast(name, text)
+				conn.SetReadDeadline(time.Now().Add(2 * keepalive))
 			}
 		}()
 	}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// registration is a registered nickname's persisted identity: a password
+// hash to check /identify attempts against, and when it was last used.
+type registration struct {
+	passHash string // hex-encoded SHA256
+	lastSeen time.Time
+}
+
+func hashPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+// nickFilename hex-encodes nick for use as a state file name, so that an
+// arbitrary nick (e.g. containing "/" or "..") can never escape
+// pool.stateDir.
+func nickFilename(nick string) string {
+	return hex.EncodeToString([]byte(nick))
+}
+
+// loadState reads every nick registration file under pool.stateDir,
+// following the goircd convention of a state directory holding one file
+// per registered nick. Missing stateDir just means nothing is persisted
+// yet, not an error.
+func (pool *ConnectionPool) loadState() error {
+	entries, err := os.ReadDir(pool.stateDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		nickBytes, err := hex.DecodeString(entry.Name())
+		if err != nil {
+			log.Printf("Skipping state file %s: not a valid nick filename", entry.Name())
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(pool.stateDir, entry.Name()))
+		if err != nil {
+			log.Printf("Skipping state file %s: %s", entry.Name(), err)
+			continue
+		}
+		lines := strings.SplitN(string(data), "\n", 2)
+		if len(lines) < 2 {
+			log.Printf("Skipping malformed state file %s", entry.Name())
+			continue
+		}
+		lastSeen, err := time.Parse(time.RFC3339, strings.TrimSpace(lines[1]))
+		if err != nil {
+			lastSeen = time.Time{}
+		}
+		pool.registrations[string(nickBytes)] = &registration{
+			passHash: strings.TrimSpace(lines[0]),
+			lastSeen: lastSeen,
+		}
+	}
+	return nil
+}
+
+// saveRegistration persists nick's password hash and last-seen time to
+// its state file, creating pool.stateDir if necessary. A no-op when no
+// -state-dir was configured.
+func (pool *ConnectionPool) saveRegistration(nick string) error {
+	if pool.stateDir == "" {
+		return nil
+	}
+	reg, ok := pool.registrations[nick]
+	if !ok {
+		return fmt.Errorf("no registration for %s", nick)
+	}
+	if err := os.MkdirAll(pool.stateDir, 0700); err != nil {
+		return err
+	}
+	content := fmt.Sprintf("%s\n%s\n", reg.passHash, reg.lastSeen.Format(time.RFC3339))
+	return os.WriteFile(filepath.Join(pool.stateDir, nickFilename(nick)), []byte(content), 0600)
+}
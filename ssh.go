@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sshFingerprint renders a public key the way ssh-keygen -l does, as a
+// base64-encoded SHA256 digest, so it can be used as a stable, printable
+// client identity independent of source address.
+func sshFingerprint(key ssh.PublicKey) string {
+	sum := sha256.Sum256(key.Marshal())
+	return "SHA256:" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// loadFingerprintSet reads a newline-separated file of fingerprints, as
+// used by both -whitelist and ban-list style checks.
+func loadFingerprintSet(path string) (map[string]bool, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	set := map[string]bool{}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		set[line] = true
+	}
+	return set, nil
+}
+
+// runSSHServer listens with an SSH server, identifying each session by
+// its client public key fingerprint (rather than RemoteAddr) and
+// terminating it into the same ConnectionPool the TCP transport uses,
+// the way ssh-chat wires a pty-less SSH session straight into its room.
+func runSSHServer(address, identityPath, admin, whitelistPath, stateDir string, keepalive time.Duration) error {
+	whitelist, err := loadFingerprintSet(whitelistPath)
+	if err != nil {
+		return err
+	}
+
+	hostKeyBytes, err := ioutil.ReadFile(identityPath)
+	if err != nil {
+		return err
+	}
+	hostKey, err := ssh.ParsePrivateKey(hostKeyBytes)
+	if err != nil {
+		return err
+	}
+
+	pool := newConnectionPool(keepalive)
+	pool.admin = admin
+	pool.stateDir = stateDir
+	if stateDir != "" {
+		if err := pool.loadState(); err != nil {
+			return err
+		}
+	}
+	defer pool.Shutdown("")
+	go pool.Run()
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			fingerprint := sshFingerprint(key)
+			if pool.banned[fingerprint] {
+				return nil, fmt.Errorf("fingerprint %s is banned", fingerprint)
+			}
+			if whitelist != nil && !whitelist[fingerprint] {
+				return nil, fmt.Errorf("fingerprint %s is not whitelisted", fingerprint)
+			}
+			return &ssh.Permissions{Extensions: map[string]string{"fingerprint": fingerprint}}, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	log.Printf("Listening for SSH on %s", address)
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigc
+		log.Printf("Received shutdown signal")
+		pool.Shutdown("Server is shutting down, goodbye!\n")
+		ln.Close()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			break
+		}
+		go handleSSHConn(conn, config, pool, keepalive)
+	}
+
+	return nil
+}
+
+// handleSSHConn performs the SSH handshake for a single connection and,
+// for every session channel opened on it, bridges stdin/stdout into the
+// pool the same way the TCP line protocol does.
+func handleSSHConn(conn net.Conn, config *ssh.ServerConfig, pool *ConnectionPool, keepalive time.Duration) {
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		log.Printf("SSH handshake with %s failed: %s", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	defer sconn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	fingerprint := sconn.Permissions.Extensions["fingerprint"]
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only session channels are supported")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			log.Printf("SSH channel accept from %s failed: %s", fingerprint, err)
+			continue
+		}
+		go ssh.DiscardRequests(requests)
+		go serveSSHSession(channel, fingerprint, pool)
+	}
+}
+
+// serveSSHSession runs the same line-oriented chat protocol as a TCP
+// client over an SSH channel, identified by pubkey fingerprint instead of
+// RemoteAddr so that nicknames and registration survive reconnects.
+func serveSSHSession(channel ssh.Channel, fingerprint string, pool *ConnectionPool) {
+	client := pool.Add(channel, fingerprint, ProtoLine)
+	defer pool.Delete(client)
+
+	scanner := bufio.NewScanner(channel)
+	for scanner.Scan() {
+		pool.Broadcast(fingerprint, scanner.Text())
+	}
+}